@@ -0,0 +1,57 @@
+package main
+
+import "strings"
+
+// passthroughArgs holds extra Bazel command-line arguments supplied after an explicit "--" on the
+// driver's own command line, split by the phase(s) they should be threaded through to.
+type passthroughArgs struct {
+	// Startup is passed before the verb (e.g. --host_jvm_args=...) to every build, test and coverage
+	// invocation the driver runs; the cquery the package phase runs to find outputs does not get it.
+	Startup []string
+	// Build is passed to `bazel build` invocations, in the build and package phases.
+	Build []string
+	// Test is passed to `bazel test`/`bazel coverage` invocations, in the test phase.
+	Test []string
+}
+
+// splitDriverArgs splits args on the first literal "--" token, mirroring the flag package's own
+// terminator convention: everything before "--" is left for flag.CommandLine (and any positional
+// arguments such as <before-revision>) to parse as usual, and everything after it is raw Bazel
+// passthrough arguments for splitPassthroughArgs to bucket by phase. If args contains no "--", all
+// of it is driver args and there are no passthrough args.
+func splitDriverArgs(args []string) (driverArgs, bazelArgs []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
+}
+
+// splitPassthroughArgs buckets the raw Bazel arguments following the driver's "--" terminator by
+// the phase(s) they apply to. An argument of the form "startup:<arg>", "build:<arg>", or
+// "test:<arg>" is routed only to that phase's Bazel invocations; any other argument is routed to
+// Build and Test, on the assumption that a flag without a phase prefix (e.g. a command option like
+// --test_output=errors or --keep_going) is meant to apply everywhere it's valid. It is deliberately
+// not also added to Startup: Bazel startup options (those that must precede the verb) are a small,
+// distinct set, and almost no ordinary command flag doubles as one, so broadcasting unprefixed args
+// there would make Bazel reject the invocation outright. A startup option must be requested
+// explicitly via the "startup:" prefix. Prefixes are matched on the raw token, so quoting that
+// keeps e.g. "test:--test_arg=a b" as a single shell word is preserved verbatim into its bucket.
+func splitPassthroughArgs(args []string) passthroughArgs {
+	var result passthroughArgs
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "startup:"):
+			result.Startup = append(result.Startup, strings.TrimPrefix(arg, "startup:"))
+		case strings.HasPrefix(arg, "build:"):
+			result.Build = append(result.Build, strings.TrimPrefix(arg, "build:"))
+		case strings.HasPrefix(arg, "test:"):
+			result.Test = append(result.Test, strings.TrimPrefix(arg, "test:"))
+		default:
+			result.Build = append(result.Build, arg)
+			result.Test = append(result.Test, arg)
+		}
+	}
+	return result
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitDriverArgs(t *testing.T) {
+	tests := []struct {
+		name           string
+		args           []string
+		wantDriverArgs []string
+		wantBazelArgs  []string
+	}{
+		{
+			name:           "no terminator",
+			args:           []string{"-flaky-retries=2", "abc123"},
+			wantDriverArgs: []string{"-flaky-retries=2", "abc123"},
+			wantBazelArgs:  nil,
+		},
+		{
+			name:           "terminator with nothing after",
+			args:           []string{"-flaky-retries=2", "abc123", "--"},
+			wantDriverArgs: []string{"-flaky-retries=2", "abc123"},
+			wantBazelArgs:  []string{},
+		},
+		{
+			name:           "flags before and passthrough after terminator",
+			args:           []string{"-flaky-retries", "2", "abc123", "--", "build:--config=ci", "test:--test_timeout=300"},
+			wantDriverArgs: []string{"-flaky-retries", "2", "abc123"},
+			wantBazelArgs:  []string{"build:--config=ci", "test:--test_timeout=300"},
+		},
+		{
+			name:           "only a terminator",
+			args:           []string{"--"},
+			wantDriverArgs: []string{},
+			wantBazelArgs:  []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotDriverArgs, gotBazelArgs := splitDriverArgs(tt.args)
+			if !reflect.DeepEqual(gotDriverArgs, tt.wantDriverArgs) {
+				t.Errorf("splitDriverArgs(%q) driverArgs = %q, want %q", tt.args, gotDriverArgs, tt.wantDriverArgs)
+			}
+			if !reflect.DeepEqual(gotBazelArgs, tt.wantBazelArgs) {
+				t.Errorf("splitDriverArgs(%q) bazelArgs = %q, want %q", tt.args, gotBazelArgs, tt.wantBazelArgs)
+			}
+		})
+	}
+}
+
+func TestSplitPassthroughArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want passthroughArgs
+	}{
+		{
+			name: "empty",
+			args: nil,
+			want: passthroughArgs{},
+		},
+		{
+			name: "unprefixed goes to build and test but not startup",
+			args: []string{"--keep_going"},
+			want: passthroughArgs{
+				Build: []string{"--keep_going"},
+				Test:  []string{"--keep_going"},
+			},
+		},
+		{
+			name: "phase-prefixed args route to a single phase, interleaved -flag=value and -flag value forms",
+			args: []string{
+				"startup:--host_jvm_args=-Xmx2g",
+				"build:--config=ci",
+				"test:--test_timeout=300",
+				"test:--test_output",
+				"test:errors",
+				"test:--test_env=FOO=bar",
+			},
+			want: passthroughArgs{
+				Startup: []string{"--host_jvm_args=-Xmx2g"},
+				Build:   []string{"--config=ci"},
+				Test:    []string{"--test_timeout=300", "--test_output", "errors", "--test_env=FOO=bar"},
+			},
+		},
+		{
+			name: "quoted value is preserved verbatim as a single argument",
+			args: []string{`test:--test_arg=a space and "quotes"`},
+			want: passthroughArgs{
+				Test: []string{`--test_arg=a space and "quotes"`},
+			},
+		},
+		{
+			name: "mix of prefixed and unprefixed args",
+			args: []string{"build:--config=ci", "--keep_going", "test:--test_timeout=300"},
+			want: passthroughArgs{
+				Build: []string{"--config=ci", "--keep_going"},
+				Test:  []string{"--keep_going", "--test_timeout=300"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitPassthroughArgs(tt.args)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitPassthroughArgs(%q) = %+v, want %+v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeBEPFile(t *testing.T, lines []string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "bep.json")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatalf("failed to write BEP fixture: %v", err)
+	}
+	return path
+}
+
+func TestStreamBEPEventsResults(t *testing.T) {
+	bepPath := writeBEPFile(t, []string{
+		`{"id":{"testSummary":{"label":"//foo:foo_test"}},"testSummary":{"overallStatus":"PASSED"}}`,
+		`{"id":{"testSummary":{"label":"//bar:bar_test"}},"testSummary":{"overallStatus":"FAILED"}}`,
+		`not valid json, should be skipped rather than aborting the scan`,
+	})
+
+	var buf bytes.Buffer
+	events := &eventWriter{w: &buf}
+
+	results, err := streamBEPEvents(bepPath, events, 1)
+	if err != nil {
+		t.Fatalf("streamBEPEvents returned error: %v", err)
+	}
+
+	want := map[string]bool{"//foo:foo_test": true, "//bar:bar_test": false}
+	if len(results) != len(want) {
+		t.Fatalf("streamBEPEvents results = %v, want %v", results, want)
+	}
+	for label, passed := range want {
+		if got, ok := results[label]; !ok || got != passed {
+			t.Errorf("results[%q] = %v, %v, want %v, true", label, got, ok, passed)
+		}
+	}
+}
+
+func TestStreamBEPEventsEmitsNormalizedEvents(t *testing.T) {
+	bepPath := writeBEPFile(t, []string{
+		`{"id":{"testResult":{"label":"//foo:foo_test"}},"testResult":{"status":"PASSED","testActionOutput":[{"uri":"file:///log.txt"}]}}`,
+		`{"id":{"targetCompleted":{"label":"//baz:baz_binary"}},"completed":{"success":true}}`,
+		`{"id":{"targetCompleted":{"label":"//qux:qux_binary"}},"completed":{"success":false}}`,
+	})
+
+	var buf bytes.Buffer
+	events := &eventWriter{w: &buf}
+
+	const attempt = 3
+	if _, err := streamBEPEvents(bepPath, events, attempt); err != nil {
+		t.Fatalf("streamBEPEvents returned error: %v", err)
+	}
+
+	var emitted []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("failed to unmarshal emitted event line %q: %v", line, err)
+		}
+		emitted = append(emitted, fields)
+	}
+
+	if len(emitted) != 3 {
+		t.Fatalf("got %d emitted events, want 3: %v", len(emitted), emitted)
+	}
+
+	testResult := emitted[0]
+	if testResult["type"] != "test_result" {
+		t.Errorf("emitted[0][\"type\"] = %v, want test_result", testResult["type"])
+	}
+	if testResult["label"] != "//foo:foo_test" {
+		t.Errorf("emitted[0][\"label\"] = %v, want //foo:foo_test", testResult["label"])
+	}
+	if testResult["attempt"] != float64(attempt) {
+		t.Errorf("emitted[0][\"attempt\"] = %v, want %d (the driver's own outer attempt, not Bazel's)", testResult["attempt"], attempt)
+	}
+	if testResult["log_path"] != "file:///log.txt" {
+		t.Errorf("emitted[0][\"log_path\"] = %v, want file:///log.txt", testResult["log_path"])
+	}
+
+	pass := emitted[1]
+	if pass["type"] != "target_completed" || pass["label"] != "//baz:baz_binary" || pass["status"] != "pass" {
+		t.Errorf("emitted[1] = %v, want a passing target_completed for //baz:baz_binary", pass)
+	}
+
+	fail := emitted[2]
+	if fail["type"] != "target_completed" || fail["label"] != "//qux:qux_binary" || fail["status"] != "fail" {
+		t.Errorf("emitted[2] = %v, want a failing target_completed for //qux:qux_binary", fail)
+	}
+}
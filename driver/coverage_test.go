@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gazelle_label "github.com/bazelbuild/bazel-gazelle/label"
+)
+
+func mustLabelCoverage(t *testing.T, s string) gazelle_label.Label {
+	t.Helper()
+	l, err := gazelle_label.Parse(s)
+	if err != nil {
+		t.Fatalf("failed to parse label %q: %v", s, err)
+	}
+	return l
+}
+
+func TestInstrumentationFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		scope string
+		tests []string
+		want  string
+	}{
+		{
+			name:  "scope all disables the filter",
+			scope: "all",
+			tests: []string{"//foo:foo_test"},
+			want:  "",
+		},
+		{
+			name:  "scope affected with no tests",
+			scope: "affected",
+			tests: nil,
+			want:  "",
+		},
+		{
+			name:  "scope affected includes each distinct package once",
+			scope: "affected",
+			tests: []string{"//foo:foo_test", "//foo:other_test", "//bar/baz:baz_test"},
+			want:  "+//foo,+//bar/baz",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels := make([]gazelle_label.Label, len(tt.tests))
+			for i, s := range tt.tests {
+				labels[i] = mustLabelCoverage(t, s)
+			}
+			cfg := &config{CoverageScope: tt.scope}
+			if got := instrumentationFilter(cfg, labels); got != tt.want {
+				t.Errorf("instrumentationFilter(scope=%q, tests=%v) = %q, want %q", tt.scope, tt.tests, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoverageMergerMergeFileDedupesLineHits(t *testing.T) {
+	dir := t.TempDir()
+
+	first := filepath.Join(dir, "first.dat")
+	firstContents := "SF:foo.go\nDA:1,1\nDA:2,0\nend_of_record\n"
+	if err := os.WriteFile(first, []byte(firstContents), 0o644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+
+	second := filepath.Join(dir, "second.dat")
+	secondContents := "SF:foo.go\nDA:1,1\nDA:3,1\nend_of_record\n"
+	if err := os.WriteFile(second, []byte(secondContents), 0o644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+
+	var out strings.Builder
+	merger := newCoverageMerger()
+	if err := merger.mergeFile(&out, first); err != nil {
+		t.Fatalf("mergeFile(first) returned error: %v", err)
+	}
+	if err := merger.mergeFile(&out, second); err != nil {
+		t.Fatalf("mergeFile(second) returned error: %v", err)
+	}
+
+	got := out.String()
+	for _, want := range []string{"SF:foo.go", "DA:1,1", "DA:2,0", "DA:3,1", "end_of_record"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("merged output missing %q:\n%s", want, got)
+		}
+	}
+	if n := strings.Count(got, "DA:1,1"); n != 1 {
+		t.Errorf("DA:1,1 (seen in both source files) should appear exactly once in the merged output, got %d times:\n%s", n, got)
+	}
+}
+
+func TestConvertLCOVToCobertura(t *testing.T) {
+	dir := t.TempDir()
+	lcovPath := filepath.Join(dir, "coverage.lcov")
+	lcov := "SF:foo.go\nDA:1,2\nDA:2,0\nend_of_record\nSF:bar.go\nDA:1,1\nend_of_record\n"
+	if err := os.WriteFile(lcovPath, []byte(lcov), 0o644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+
+	outPath := filepath.Join(dir, "coverage.xml")
+	if err := convertLCOVToCobertura(lcovPath, outPath); err != nil {
+		t.Fatalf("convertLCOVToCobertura returned error: %v", err)
+	}
+
+	contents, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("failed to read converted output: %v", err)
+	}
+	got := string(contents)
+	for _, want := range []string{
+		`<class filename="foo.go">`,
+		`<line number="1" hits="2"/>`,
+		`<line number="2" hits="0"/>`,
+		`<class filename="bar.go">`,
+		`<line number="1" hits="1"/>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("converted output missing %q:\n%s", want, got)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 // driver is a binary for driving a CI process based on the affected targets.
-// Though the general flow of "determine targets" -> "run tests" -> "package binaries" could ideally
-// be modelled as independent processes feeding into each other, in practice it can be useful to
-// orchestrate these stages using a single high-context driver.
+// The general flow of "determine targets" -> "run tests" -> "package binaries" is modelled as
+// distinct phases, because in practice it can be useful to orchestrate these stages using a
+// single high-context driver.
 // For instance, the test phase should ideally be just `bazel test [targets]` but:
 //  1. `bazel test [only-buildable-non-testable-targets] errors
 //  2. `bazel test [no targets]` errors.
@@ -10,13 +10,22 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bazel-contrib/target-determinator/cli"
 	"github.com/bazel-contrib/target-determinator/pkg"
@@ -24,18 +33,185 @@ import (
 	gazelle_label "github.com/bazelbuild/bazel-gazelle/label"
 )
 
+// phase identifies one of the sequential stages the driver can run.
+type phase string
+
+const (
+	phaseBuild   phase = "build"
+	phaseTest    phase = "test"
+	phasePackage phase = "package"
+)
+
+// allPhases is the order phases run in when none are skipped.
+var allPhases = []phase{phaseBuild, phaseTest, phasePackage}
+
 type driverFlags struct {
-	commonFlags    *cli.CommonFlags
-	revisionBefore string
-	manualTestMode string
+	commonFlags       *cli.CommonFlags
+	revisionBefore    string
+	manualTestMode    string
+	phases            string
+	packageDir        string
+	flakyRetries      int
+	summaryJSON       string
+	coverageDir       string
+	coverageScope     string
+	coverageCobertura bool
+	shardIndex        int
+	shardCount        int
+	timingsJSON       string
+	testTagFilters    string
+	buildTagFilters   string
+	eventsJSON        string
+	passthrough       passthroughArgs
 }
 
 type config struct {
 	Context        *pkg.Context
 	RevisionBefore pkg.LabelledGitRev
 	TargetPattern  gazelle_label.Pattern
-	// One of "run" or "skip".
-	ManualTestMode string
+	Phases         map[phase]bool
+	PackageDir     string
+	// TestTagFilters and BuildTagFilters mirror Bazel's own --test_tag_filters/--build_tag_filters:
+	// a target is included only if it matches every "+" selector and none of the "-" selectors.
+	// TestTagFilters is applied only to "*_test" targets; BuildTagFilters is applied to everything.
+	TestTagFilters  tagFilter
+	BuildTagFilters tagFilter
+	// FlakyRetries is how many additional times a failing test target is re-run before it is
+	// considered genuinely failing, rather than flaky.
+	FlakyRetries int
+	// SummaryJSON is the path to write the per-test retry summary to, or "" to skip writing one.
+	SummaryJSON string
+	// CoverageDir, if non-empty, switches the test phase to `bazel coverage` and writes a merged
+	// lcov report there.
+	CoverageDir string
+	// CoverageScope is one of "affected" or "all", controlling whether --instrumentation_filter is
+	// scoped to the packages of the affected test targets or left unset to measure the whole repo.
+	// The affected scope is per package: it is not narrowed to the changed source files.
+	CoverageScope string
+	// CoverageCobertura additionally converts the merged lcov report to Cobertura XML.
+	CoverageCobertura bool
+	// ShardIndex and ShardCount split the affected test targets across ShardCount CI workers, of
+	// which this invocation is worker ShardIndex. ShardCount of 1 (the default) disables sharding.
+	ShardIndex int
+	ShardCount int
+	// TimingsJSON is an optional path to historical per-test durations, used to weight-balance
+	// shard assignment instead of splitting tests evenly by count.
+	TimingsJSON string
+	// Events streams a normalized event for each phase and target/test outcome to -events-json.
+	// It is nil (and every method on it a no-op) when -events-json was not given.
+	Events *eventWriter
+	// Passthrough holds extra Bazel arguments given after "--" on the driver's own command line,
+	// bucketed by the phase(s) they apply to. See splitPassthroughArgs.
+	Passthrough passthroughArgs
+}
+
+// eventWriter streams normalized driver events as newline-delimited JSON to -events-json (or
+// stdout when that flag is "-"), giving downstream CI orchestrators (Buildkite, GitHub Actions,
+// custom dashboards) a stable schema independent of Bazel's own BEP version churn. A nil
+// *eventWriter is valid and every method on it is a no-op, so callers don't need to check whether
+// -events-json was set.
+type eventWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func newEventWriter(path string) (*eventWriter, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if path == "-" {
+		return &eventWriter{w: os.Stdout}, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create events json file %s: %w", path, err)
+	}
+	return &eventWriter{w: file, closer: file}, nil
+}
+
+func (e *eventWriter) Close() error {
+	if e == nil || e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
+
+func (e *eventWriter) emit(eventType string, fields map[string]interface{}) {
+	if e == nil {
+		return
+	}
+	fields["type"] = eventType
+	contents, err := json.Marshal(fields)
+	if err != nil {
+		log.Printf("Failed to marshal %s event: %v", eventType, err)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fmt.Fprintln(e.w, string(contents))
+}
+
+func (e *eventWriter) affectedTargetsDiscovered(buckets *targetBuckets) {
+	e.emit("affected_targets_discovered", map[string]interface{}{
+		"tests":    len(buckets.Tests),
+		"binaries": len(buckets.Binaries),
+		"other":    len(buckets.Other),
+		"total":    len(buckets.All()),
+	})
+}
+
+func (e *eventWriter) phaseStarted(p phase) {
+	e.emit("phase_started", map[string]interface{}{"phase": string(p)})
+}
+
+func (e *eventWriter) phaseFinished(p phase, err error) {
+	fields := map[string]interface{}{"phase": string(p), "success": err == nil}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	e.emit("phase_finished", fields)
+}
+
+func (e *eventWriter) targetCompleted(label, status string, duration time.Duration) {
+	e.emit("target_completed", map[string]interface{}{
+		"label":       label,
+		"status":      status,
+		"duration_ms": duration.Milliseconds(),
+	})
+}
+
+func (e *eventWriter) testResult(label string, attempt int, status, logPath string) {
+	e.emit("test_result", map[string]interface{}{
+		"label":    label,
+		"attempt":  attempt,
+		"status":   status,
+		"log_path": logPath,
+	})
+}
+
+func (e *eventWriter) driverSummary(fields map[string]interface{}) {
+	e.emit("driver_summary", fields)
+}
+
+// targetBuckets partitions the affected targets discovered by WalkAffectedTargets by rule kind,
+// so that each phase can be run against only the targets it applies to.
+type targetBuckets struct {
+	// Tests holds every "*_test" target.
+	Tests []gazelle_label.Label
+	// Binaries holds every "*_binary" target, which can be packaged/run but not tested.
+	Binaries []gazelle_label.Label
+	// Other holds everything else (libraries and other buildable-only rules).
+	Other []gazelle_label.Label
+}
+
+// All returns the union of every bucket, in the order they were discovered by rule kind.
+func (b *targetBuckets) All() []gazelle_label.Label {
+	all := make([]gazelle_label.Label, 0, len(b.Tests)+len(b.Binaries)+len(b.Other))
+	all = append(all, b.Tests...)
+	all = append(all, b.Binaries...)
+	all = append(all, b.Other...)
+	return all
 }
 
 func main() {
@@ -45,6 +221,7 @@ func main() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
 		fmt.Fprintf(flag.CommandLine.Output(), "  %s <before-revision>\n", filepath.Base(os.Args[0]))
 		fmt.Fprintf(flag.CommandLine.Output(), "Where <before-revision> may be any commit-like strings - full commit hashes, short commit hashes, tags, branches, etc.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Arguments after a literal \"--\" are passed through to Bazel: \"startup:\", \"build:\", or \"test:\" prefixed arguments go only to that phase's invocations, and unprefixed arguments go to build and test invocations (use the \"startup:\" prefix for a Bazel startup option).\n")
 		fmt.Fprintf(flag.CommandLine.Output(), "Optional flags:\n")
 		flag.PrintDefaults()
 		os.Exit(1)
@@ -55,18 +232,32 @@ func main() {
 		log.Fatalf("Error during preprocessing: %v", err)
 	}
 
-	var targets []gazelle_label.Label
-	commandVerb := "build"
+	events, err := newEventWriter(flags.eventsJSON)
+	if err != nil {
+		log.Fatalf("Failed to set up -events-json: %v", err)
+	}
+	config.Events = events
+	defer events.Close()
+
+	buckets := &targetBuckets{}
 
 	log.Println("Discovering affected targets")
 	callback := func(label gazelle_label.Label, differences []pkg.Difference, configuredTarget *analysis.ConfiguredTarget) {
-		if config.ManualTestMode == "skip" && isTaggedManual(configuredTarget) {
+		if !matchTagFilters(configuredTarget, config.BuildTagFilters) {
 			return
 		}
-		targets = append(targets, label)
-		// This is not an ideal heuristic, ideally cquery would expose to us whether a target is a test target.
-		if strings.HasSuffix(configuredTarget.GetTarget().GetRule().GetRuleClass(), "_test") {
-			commandVerb = "test"
+		switch ruleClass := configuredTarget.GetTarget().GetRule().GetRuleClass(); {
+		// This is not an ideal heuristic, ideally cquery would expose to us whether a target is a test
+		// or binary target.
+		case strings.HasSuffix(ruleClass, "_test"):
+			if !matchTagFilters(configuredTarget, config.TestTagFilters) {
+				return
+			}
+			buckets.Tests = append(buckets.Tests, label)
+		case strings.HasSuffix(ruleClass, "_binary"):
+			buckets.Binaries = append(buckets.Binaries, label)
+		default:
+			buckets.Other = append(buckets.Other, label)
 		}
 	}
 
@@ -78,65 +269,838 @@ func main() {
 		log.Fatal(err)
 	}
 
-	if len(targets) == 0 {
+	if len(buckets.All()) == 0 {
 		log.Println("No targets were affected, not running Bazel")
 		os.Exit(0)
 	}
 
-	log.Printf("Discovered %d affected targets", len(targets))
+	log.Printf("Discovered %d affected targets (%d tests, %d binaries, %d other)",
+		len(buckets.All()), len(buckets.Tests), len(buckets.Binaries), len(buckets.Other))
+	config.Events.affectedTargetsDiscovered(buckets)
+
+	if config.ShardCount > 1 {
+		sharded, err := shardTestTargets(buckets.Tests, config.ShardIndex, config.ShardCount, config.TimingsJSON)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Shard %d/%d selected %d of %d affected test targets", config.ShardIndex, config.ShardCount, len(sharded), len(buckets.Tests))
+		buckets.Tests = sharded
+		if config.ShardIndex != 0 {
+			// Shard 0 is exclusively responsible for the build-only bucket, so non-test targets
+			// aren't built redundantly by every shard.
+			buckets.Binaries = nil
+			buckets.Other = nil
+		}
+	}
+
+	var phaseErr error
+	if config.Phases[phaseBuild] {
+		phaseErr = runPhase(config, phaseBuild, "build", buckets.All())
+	}
+
+	if phaseErr == nil && config.Phases[phaseTest] {
+		phaseErr = runTestPhase(config, buckets.Tests)
+	}
+
+	if phaseErr == nil && config.Phases[phasePackage] {
+		phaseErr = runPackagePhase(config, buckets.Binaries)
+	}
+
+	summaryFields := map[string]interface{}{
+		"targets": len(buckets.All()),
+		"tests":   len(buckets.Tests),
+		"success": phaseErr == nil,
+	}
+	if phaseErr != nil {
+		summaryFields["error"] = phaseErr.Error()
+	}
+	config.Events.driverSummary(summaryFields)
+
+	if phaseErr != nil {
+		log.Fatal(phaseErr)
+	}
+}
+
+// runPhase runs a single Bazel invocation of commandVerb over targets, short-circuiting cleanly
+// when targets is empty rather than letting Bazel fail on an empty pattern file.
+func runPhase(config *config, p phase, commandVerb string, targets []gazelle_label.Label) error {
+	if len(targets) == 0 {
+		log.Printf("Phase %q has no targets to act on, skipping", p)
+		return nil
+	}
+
+	config.Events.phaseStarted(p)
+	_, err := runBazelCommand(config, commandVerb, nil, targets, 1)
+	if err != nil {
+		err = fmt.Errorf("%q phase failed: %w", p, err)
+	}
+	config.Events.phaseFinished(p, err)
+	return err
+}
+
+// runBazelCommand runs a single Bazel invocation, always requesting a --build_event_json_file so
+// its outcome can be streamed into normalized events on config.Events. config.Passthrough.Startup
+// is inserted before the verb, and config.Passthrough.Build or config.Passthrough.Test is appended
+// after extraArgs depending on verb, so that Bazel arguments passed to the driver after "--" reach
+// the right phase's invocation. attempt is the driver's own outer retry attempt (1 for phases that
+// don't retry), and is stamped onto any test_result events in place of Bazel's own per-invocation
+// attempt counter, which always reads back as 1 since each retry is a brand new `bazel test`
+// process rather than a `--runs_per_test` rerun within one. It returns, for test or coverage
+// invocations, whether each requested target's test summary reported an overall pass; the map is
+// empty for other verbs. Bazel's own exit code conflates "some test failed" with other fatal
+// errors, so for test/coverage invocations the exit code is ignored in favour of the per-target
+// results read back from the BEP stream.
+func runBazelCommand(config *config, verb string, extraArgs []string, targets []gazelle_label.Label, attempt int) (map[string]bool, error) {
+	targetPatternFile, err := writeTargetPatternFile(targets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare %s invocation: %w", verb, err)
+	}
+
+	bepFile, err := os.CreateTemp("", "bep-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file for build event json: %w", err)
+	}
+	bepFile.Close()
+
+	args := append([]string{}, config.Passthrough.Startup...)
+	args = append(args, verb,
+		"--target_pattern_file", targetPatternFile,
+		"--build_event_json_file", bepFile.Name())
+	args = append(args, extraArgs...)
+	switch verb {
+	case "build":
+		args = append(args, config.Passthrough.Build...)
+	case "test", "coverage":
+		args = append(args, config.Passthrough.Test...)
+	}
+
+	log.Printf("Running %s on %d targets", verb, len(targets))
+	cmd := exec.Command(config.Context.BazelPath, args...)
+	cmd.Dir = config.Context.WorkspacePath
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	runErr := cmd.Run()
 
+	results, err := streamBEPEvents(bepFile.Name(), config.Events, attempt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse build event json for %s: %w", verb, err)
+	}
+
+	if verb == "test" || verb == "coverage" {
+		// A test/coverage invocation that produced no results at all for a non-empty target set
+		// didn't fail because of failing tests - it failed for some other reason (a bad BUILD
+		// file, a fetch failure, an OOM, a crash before any test ran) that a retry won't fix.
+		// Report that as a hard failure instead of letting every target be scored "failed" and
+		// burn through the whole -flaky-retries budget on a failure that can't self-heal.
+		if len(results) == 0 && len(targets) > 0 {
+			if runErr != nil {
+				return results, fmt.Errorf("%s invocation produced no test results: %w", verb, runErr)
+			}
+			return results, fmt.Errorf("%s invocation produced no test results", verb)
+		}
+		return results, nil
+	}
+	return results, runErr
+}
+
+// testStatus is the final verdict the driver assigns a test target once it has exhausted its
+// retry budget.
+type testStatus string
+
+const (
+	testStatusPass  testStatus = "pass"
+	testStatusFlaky testStatus = "flaky"
+	testStatusFail  testStatus = "fail"
+)
+
+// testSummaryEntry is the machine-readable record written to -summary-json for a single test
+// target.
+type testSummaryEntry struct {
+	Target   string        `json:"target"`
+	Status   testStatus    `json:"status"`
+	Attempts []attemptInfo `json:"attempts"`
+}
+
+type attemptInfo struct {
+	Attempt int  `json:"attempt"`
+	Passed  bool `json:"passed"`
+}
+
+// classifyTestStatus derives a target's final testStatus from its ordered attempt history:
+// passing on the first attempt is testStatusPass, passing only on a later attempt is
+// testStatusFlaky, and never passing (including an empty history, e.g. the phase aborted before
+// this target ran) is testStatusFail.
+func classifyTestStatus(attempts []attemptInfo) testStatus {
+	for i, a := range attempts {
+		if a.Passed {
+			if i == 0 {
+				return testStatusPass
+			}
+			return testStatusFlaky
+		}
+	}
+	return testStatusFail
+}
+
+// runTestPhase runs `bazel test` over tests, retrying targets that failed up to
+// config.FlakyRetries additional times. Borrowed from the approach in Tailscale's
+// cmd/testwrapper: a target that eventually passes is reported as flaky rather than failed, so
+// CI can distinguish real regressions from flakes. It writes a summary to config.SummaryJSON (if
+// set) and returns an error if any target is still failing after all retries.
+func runTestPhase(config *config, tests []gazelle_label.Label) error {
+	if len(tests) == 0 {
+		log.Printf("Phase %q has no targets to act on, skipping", phaseTest)
+		return nil
+	}
+	config.Events.phaseStarted(phaseTest)
+
+	verb := "test"
+	var extraArgs []string
+	if config.CoverageDir != "" {
+		verb = "coverage"
+		extraArgs = append(extraArgs, "--combined_report=lcov")
+		if filter := instrumentationFilter(config, tests); filter != "" {
+			extraArgs = append(extraArgs, "--instrumentation_filter="+filter)
+		}
+	}
+
+	remaining := tests
+	attempts := make(map[string][]attemptInfo, len(tests))
+
+	var phaseErr error
+	for attempt := 1; phaseErr == nil; attempt++ {
+		results, err := runBazelCommand(config, verb, extraArgs, remaining, attempt)
+		if err != nil {
+			phaseErr = fmt.Errorf("failed attempt %d of %q phase: %w", attempt, phaseTest, err)
+			break
+		}
+
+		var stillFailing []gazelle_label.Label
+		for _, target := range remaining {
+			passed := results[target.String()]
+			attempts[target.String()] = append(attempts[target.String()], attemptInfo{Attempt: attempt, Passed: passed})
+			if !passed {
+				stillFailing = append(stillFailing, target)
+			}
+		}
+
+		if len(stillFailing) == 0 {
+			break
+		}
+		if attempt > config.FlakyRetries {
+			remaining = stillFailing
+			break
+		}
+		log.Printf("%d target(s) failed on attempt %d, retrying as possibly flaky", len(stillFailing), attempt)
+		remaining = stillFailing
+	}
+
+	if phaseErr == nil && config.CoverageDir != "" {
+		if err := mergeCoverageOutputs(config); err != nil {
+			phaseErr = fmt.Errorf("failed to merge coverage output: %w", err)
+		}
+	}
+
+	if phaseErr == nil {
+		summary := make([]testSummaryEntry, 0, len(tests))
+		var failed []string
+		for _, target := range tests {
+			targetAttempts := attempts[target.String()]
+			status := classifyTestStatus(targetAttempts)
+			if status == testStatusFail {
+				failed = append(failed, target.String())
+			}
+			summary = append(summary, testSummaryEntry{
+				Target:   target.String(),
+				Status:   status,
+				Attempts: targetAttempts,
+			})
+		}
+
+		if config.SummaryJSON != "" {
+			if err := writeSummaryJSON(config.SummaryJSON, summary); err != nil {
+				phaseErr = fmt.Errorf("failed to write test summary: %w", err)
+			}
+		}
+
+		if phaseErr == nil && len(failed) > 0 {
+			phaseErr = fmt.Errorf("%q phase failed: %d target(s) still failing after retries: %s",
+				phaseTest, len(failed), strings.Join(failed, ", "))
+		}
+	}
+
+	config.Events.phaseFinished(phaseTest, phaseErr)
+	return phaseErr
+}
+
+// streamBEPEvents scans a Build Event Protocol JSON file (as produced by
+// --build_event_json_file), emitting a normalized target_completed or test_result event for each
+// relevant BEP event it sees, and returns, for each test target whose summary it saw, whether that
+// summary reported an overall passing status. Emitted test_result events are stamped with attempt
+// (the driver's own outer retry attempt) rather than Bazel's own id.testResult.attempt, which is
+// always 1 for a plain retried invocation and so can't distinguish the driver's successive
+// flaky-retry attempts from one another.
+func streamBEPEvents(bepPath string, events *eventWriter, attempt int) (map[string]bool, error) {
+	file, err := os.Open(bepPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open build event json file: %w", err)
+	}
+	defer file.Close()
+
+	results := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event struct {
+			ID struct {
+				TestSummary struct {
+					Label string `json:"label"`
+				} `json:"testSummary"`
+				TestResult struct {
+					Label string `json:"label"`
+				} `json:"testResult"`
+				TargetCompleted struct {
+					Label string `json:"label"`
+				} `json:"targetCompleted"`
+			} `json:"id"`
+			TestSummary struct {
+				OverallStatus string `json:"overallStatus"`
+			} `json:"testSummary"`
+			TestResult struct {
+				Status           string `json:"status"`
+				TestActionOutput []struct {
+					URI string `json:"uri"`
+				} `json:"testActionOutput"`
+			} `json:"testResult"`
+			Completed struct {
+				Success bool `json:"success"`
+			} `json:"completed"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// Not every BEP line is an event shape we care about; skip lines we can't parse.
+			continue
+		}
+		switch {
+		case event.ID.TestSummary.Label != "":
+			results[event.ID.TestSummary.Label] = event.TestSummary.OverallStatus == "PASSED"
+		case event.ID.TestResult.Label != "":
+			logPath := ""
+			if len(event.TestResult.TestActionOutput) > 0 {
+				logPath = event.TestResult.TestActionOutput[0].URI
+			}
+			events.testResult(event.ID.TestResult.Label, attempt, event.TestResult.Status, logPath)
+		case event.ID.TargetCompleted.Label != "":
+			status := "fail"
+			if event.Completed.Success {
+				status = "pass"
+			}
+			// The BEP "completed" event doesn't surface a per-target wall-clock duration, so we
+			// report 0 rather than guess at one.
+			events.targetCompleted(event.ID.TargetCompleted.Label, status, 0)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan build event json file: %w", err)
+	}
+	return results, nil
+}
+
+func writeSummaryJSON(path string, summary []testSummaryEntry) error {
+	contents, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal summary: %w", err)
+	}
+	return os.WriteFile(path, contents, 0o644)
+}
+
+// instrumentationFilter builds a bazel --instrumentation_filter value scoped to the packages of
+// the affected test targets when config.CoverageScope is "affected". It returns "" (meaning no
+// filter, so every package is instrumented) when the scope is "all".
+func instrumentationFilter(config *config, tests []gazelle_label.Label) string {
+	if config.CoverageScope != "affected" {
+		return ""
+	}
+	seen := make(map[string]bool, len(tests))
+	var patterns []string
+	for _, t := range tests {
+		pattern := "+//" + t.Pkg
+		if seen[pattern] {
+			continue
+		}
+		seen[pattern] = true
+		patterns = append(patterns, pattern)
+	}
+	return strings.Join(patterns, ",")
+}
+
+// coverageMerger appends LCOV records from multiple source files into a single writer,
+// deduplicating DA (line hit) records already seen for a given source file so that coverage
+// contributed by more than one shard isn't double counted. Modelled on the single
+// mutex-protected writer used by cmd/go/internal/test/cover.go to merge coverage profiles.
+type coverageMerger struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func newCoverageMerger() *coverageMerger {
+	return &coverageMerger{seen: make(map[string]bool)}
+}
+
+func (m *coverageMerger) mergeFile(w io.Writer, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var currentSF string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "SF:"):
+			currentSF = strings.TrimPrefix(line, "SF:")
+		case strings.HasPrefix(line, "DA:"):
+			key := currentSF + ":" + line
+			if m.seen[key] {
+				continue
+			}
+			m.seen[key] = true
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// mergeCoverageOutputs walks bazel-out/_coverage/_coverage_report.dat (the combined report
+// produced by --combined_report=lcov) and any per-target bazel-testlogs/.../coverage.dat files,
+// merges them into a single lcov file under config.CoverageDir, and optionally converts that file
+// to Cobertura XML.
+func mergeCoverageOutputs(config *config) error {
+	if err := os.MkdirAll(config.CoverageDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create coverage directory %s: %w", config.CoverageDir, err)
+	}
+
+	var sources []string
+	combined := filepath.Join(config.Context.WorkspacePath, "bazel-out", "_coverage", "_coverage_report.dat")
+	if _, err := os.Stat(combined); err == nil {
+		sources = append(sources, combined)
+	}
+	testlogsRoot := filepath.Join(config.Context.WorkspacePath, "bazel-testlogs")
+	_ = filepath.WalkDir(testlogsRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if d.Name() == "coverage.dat" {
+			sources = append(sources, path)
+		}
+		return nil
+	})
+
+	if len(sources) == 0 {
+		log.Println("No coverage output found to merge")
+		return nil
+	}
+
+	outPath := filepath.Join(config.CoverageDir, "coverage.lcov")
+	out, err := os.Create(outPath)
+	if err != nil {
+		return fmt.Errorf("failed to create merged coverage file: %w", err)
+	}
+	defer out.Close()
+
+	merger := newCoverageMerger()
+	for _, src := range sources {
+		if err := merger.mergeFile(out, src); err != nil {
+			return fmt.Errorf("failed to merge coverage from %s: %w", src, err)
+		}
+	}
+	log.Printf("Wrote merged coverage report to %s", outPath)
+
+	if config.CoverageCobertura {
+		cob := filepath.Join(config.CoverageDir, "coverage.xml")
+		if err := convertLCOVToCobertura(outPath, cob); err != nil {
+			return fmt.Errorf("failed to convert coverage to Cobertura: %w", err)
+		}
+		log.Printf("Wrote Cobertura coverage report to %s", cob)
+	}
+	return nil
+}
+
+// convertLCOVToCobertura converts a merged lcov file into a minimal Cobertura XML document
+// sufficient for CI dashboards that consume line coverage per class.
+func convertLCOVToCobertura(lcovPath, outPath string) error {
+	type lineHit struct {
+		Number int
+		Hits   int
+	}
+	type classCoverage struct {
+		Filename string
+		Lines    []lineHit
+	}
+
+	file, err := os.Open(lcovPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var classes []*classCoverage
+	var current *classCoverage
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "SF:"):
+			current = &classCoverage{Filename: strings.TrimPrefix(line, "SF:")}
+			classes = append(classes, current)
+		case strings.HasPrefix(line, "DA:") && current != nil:
+			parts := strings.SplitN(strings.TrimPrefix(line, "DA:"), ",", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			number, errNum := strconv.Atoi(parts[0])
+			hits, errHits := strconv.Atoi(parts[1])
+			if errNum != nil || errHits != nil {
+				continue
+			}
+			current.Lines = append(current.Lines, lineHit{Number: number, Hits: hits})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?>` + "\n")
+	b.WriteString("<coverage>\n  <packages>\n    <package>\n      <classes>\n")
+	for _, class := range classes {
+		fmt.Fprintf(&b, "        <class filename=%q>\n          <lines>\n", class.Filename)
+		for _, l := range class.Lines {
+			fmt.Fprintf(&b, "            <line number=\"%d\" hits=\"%d\"/>\n", l.Number, l.Hits)
+		}
+		b.WriteString("          </lines>\n        </class>\n")
+	}
+	b.WriteString("      </classes>\n    </package>\n  </packages>\n</coverage>\n")
+
+	return os.WriteFile(outPath, []byte(b.String()), 0o644)
+}
+
+// runPackagePhase builds the affected binaries, unless the build phase already built them this
+// run, and copies their default outputs into config.PackageDir.
+func runPackagePhase(config *config, binaries []gazelle_label.Label) error {
+	if len(binaries) == 0 {
+		log.Println("Phase \"package\" has no binary targets to act on, skipping")
+		return nil
+	}
+	if config.PackageDir == "" {
+		log.Println("Phase \"package\" has binary targets but no -package-dir was given, skipping")
+		return nil
+	}
+
+	config.Events.phaseStarted(phasePackage)
+	err := func() error {
+		if !config.Phases[phaseBuild] {
+			if _, err := runBazelCommand(config, "build", nil, binaries, 1); err != nil {
+				return fmt.Errorf("%q phase failed: %w", phasePackage, err)
+			}
+		}
+
+		if err := os.MkdirAll(config.PackageDir, 0o755); err != nil {
+			return fmt.Errorf("failed to create package directory %s: %w", config.PackageDir, err)
+		}
+
+		for _, binary := range binaries {
+			if err := copyBazelOutput(config, binary); err != nil {
+				return fmt.Errorf("failed to copy output of %s into %s: %w", binary.String(), config.PackageDir, err)
+			}
+		}
+		return nil
+	}()
+	config.Events.phaseFinished(phasePackage, err)
+	return err
+}
+
+func writeTargetPatternFile(targets []gazelle_label.Label) (string, error) {
 	targetPatternFile, err := os.CreateTemp("", "")
 	if err != nil {
-		log.Fatalf("Failed to create temporary file for target patterns: %v", err)
+		return "", fmt.Errorf("failed to create temporary file for target patterns: %w", err)
 	}
 	for _, target := range targets {
 		if _, err := targetPatternFile.WriteString(target.String()); err != nil {
-			log.Fatalf("Failed to write target pattern to target pattern file: %v", err)
+			return "", fmt.Errorf("failed to write target pattern to target pattern file: %w", err)
 		}
 		if _, err := targetPatternFile.WriteString("\n"); err != nil {
-			log.Fatalf("Failed to write target pattern to target pattern file: %v", err)
+			return "", fmt.Errorf("failed to write target pattern to target pattern file: %w", err)
 		}
 	}
 	if err := targetPatternFile.Sync(); err != nil {
-		log.Fatalf("Failed to sync target pattern file: %v", err)
+		return "", fmt.Errorf("failed to sync target pattern file: %w", err)
 	}
 	if err := targetPatternFile.Close(); err != nil {
-		log.Fatalf("Failed to close target pattern file: %v", err)
+		return "", fmt.Errorf("failed to close target pattern file: %w", err)
 	}
+	return targetPatternFile.Name(), nil
+}
 
-	log.Printf("Running %s on %d targets", commandVerb, len(targets))
-	cmd := exec.Command(config.Context.BazelPath, commandVerb, "--target_pattern_file", targetPatternFile.Name())
-	cmd.Dir = config.Context.WorkspacePath
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Fatal(err)
+// copyBazelOutput queries Bazel for the default output of a binary target and copies it into
+// config.PackageDir, preserving the binary's base name.
+func copyBazelOutput(config *config, binary gazelle_label.Label) error {
+	cqueryOut, err := exec.Command(config.Context.BazelPath, "cquery", binary.String(), "--output=files").Output()
+	if err != nil {
+		return fmt.Errorf("failed to query outputs: %w", err)
+	}
+	for _, output := range strings.Fields(string(cqueryOut)) {
+		dest := filepath.Join(config.PackageDir, filepath.Base(output))
+		src := output
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(config.Context.WorkspacePath, src)
+		}
+		contents, err := os.ReadFile(src)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", src, err)
+		}
+		if err := os.WriteFile(dest, contents, 0o755); err != nil {
+			return fmt.Errorf("failed to write %s: %w", dest, err)
+		}
 	}
+	return nil
 }
 
-func isTaggedManual(target *analysis.ConfiguredTarget) bool {
+// tagFilter is a parsed "+tag,-tag,..." selector list, as accepted by -test-tag-filters and
+// -build-tag-filters, mirroring Bazel's own --test_tag_filters/--build_tag_filters.
+type tagFilter struct {
+	Require []string
+	Exclude []string
+}
+
+// parseTagFilters parses a comma-separated list of "+tag" (require) and "-tag" (exclude)
+// selectors.
+func parseTagFilters(raw string) (tagFilter, error) {
+	var filter tagFilter
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(part, "+"):
+			filter.Require = append(filter.Require, part[1:])
+		case strings.HasPrefix(part, "-"):
+			filter.Exclude = append(filter.Exclude, part[1:])
+		default:
+			return tagFilter{}, fmt.Errorf("tag filter entries must start with + or -, saw: %q", part)
+		}
+	}
+	return filter, nil
+}
+
+// applyLegacyManualTestMode translates the legacy -manual-test-mode=skip flag into the
+// TestTagFilters/BuildTagFilters it replaced. -manual-test-mode=skip used to back a
+// pre-bucketing isTaggedManual check that skipped manual-tagged affected targets of every kind,
+// not just tests, so it's translated into an implicit "-manual" exclude on both filters (if not
+// already present) rather than TestTagFilters alone, so existing CI invocations keep getting
+// manual-tagged binaries and libraries skipped too. manualTestMode == "run" is a no-op: both
+// filters are returned unchanged.
+func applyLegacyManualTestMode(manualTestMode string, testTagFilters, buildTagFilters tagFilter) (tagFilter, tagFilter) {
+	if manualTestMode != "skip" {
+		return testTagFilters, buildTagFilters
+	}
+	if !containsString(testTagFilters.Exclude, "manual") {
+		testTagFilters.Exclude = append(testTagFilters.Exclude, "manual")
+	}
+	if !containsString(buildTagFilters.Exclude, "manual") {
+		buildTagFilters.Exclude = append(buildTagFilters.Exclude, "manual")
+	}
+	return testTagFilters, buildTagFilters
+}
+
+// targetTags returns the "tags" attribute of a configured target's rule, or nil if it has none.
+func targetTags(target *analysis.ConfiguredTarget) []string {
 	for _, attr := range target.GetTarget().GetRule().GetAttribute() {
 		if attr.GetName() == "tags" {
-			for _, tag := range attr.GetStringListValue() {
-				if tag == "manual" {
-					return true
-				}
+			return attr.GetStringListValue()
+		}
+	}
+	return nil
+}
+
+// matchTagFilters reports whether target is included by filter: it must carry every tag in
+// filter.Require and none of the tags in filter.Exclude.
+func matchTagFilters(target *analysis.ConfiguredTarget, filter tagFilter) bool {
+	tags := targetTags(target)
+	tagSet := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tagSet[tag] = true
+	}
+	for _, required := range filter.Require {
+		if !tagSet[required] {
+			return false
+		}
+	}
+	for _, excluded := range filter.Exclude {
+		if tagSet[excluded] {
+			return false
+		}
+	}
+	return true
+}
+
+// shardTestTargets sorts tests lexicographically for determinism and returns only the subset
+// assigned to shardIndex out of shardCount total shards, so that running the same command on N CI
+// machines executes every affected test exactly once between them. When timingsPath names a
+// historical per-test duration file, assignment greedily longest-processing-time bin-packs tests
+// across shards by weight instead of splitting by a stable hash, so that one shard isn't dominated
+// by a single slow test.
+func shardTestTargets(tests []gazelle_label.Label, shardIndex, shardCount int, timingsPath string) ([]gazelle_label.Label, error) {
+	sorted := append([]gazelle_label.Label(nil), tests...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].String() < sorted[j].String() })
+
+	timings, err := loadTimings(timingsPath)
+	if err != nil {
+		return nil, err
+	}
+	if timings == nil {
+		var assigned []gazelle_label.Label
+		for _, t := range sorted {
+			if int(stableHash(t.String())%uint32(shardCount)) == shardIndex {
+				assigned = append(assigned, t)
 			}
 		}
+		return assigned, nil
 	}
-	return false
+
+	return lptAssign(sorted, timings, shardIndex, shardCount), nil
+}
+
+// stableHash hashes a target label to a shard bucket deterministically across runs and machines.
+func stableHash(s string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// loadTimings reads a -timings-json file mapping target label to historical duration in seconds.
+// It returns (nil, nil) when path is empty, so callers can fall back to the stable-hash split.
+func loadTimings(path string) (map[string]float64, error) {
+	if path == "" {
+		return nil, nil
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read timings json %s: %w", path, err)
+	}
+	var timings map[string]float64
+	if err := json.Unmarshal(contents, &timings); err != nil {
+		return nil, fmt.Errorf("failed to parse timings json %s: %w", path, err)
+	}
+	return timings, nil
+}
+
+// lptAssign greedily assigns the heaviest-weighted (by historical duration) test first to
+// whichever shard currently has the least total weight, a standard longest-processing-time
+// bin-packing heuristic. Targets with no recorded timing are assumed to have weight 1.
+func lptAssign(targets []gazelle_label.Label, timings map[string]float64, shardIndex, shardCount int) []gazelle_label.Label {
+	type weightedTarget struct {
+		Target gazelle_label.Label
+		Weight float64
+	}
+	weighted := make([]weightedTarget, len(targets))
+	for i, t := range targets {
+		weight, ok := timings[t.String()]
+		if !ok {
+			weight = 1
+		}
+		weighted[i] = weightedTarget{Target: t, Weight: weight}
+	}
+	sort.SliceStable(weighted, func(i, j int) bool { return weighted[i].Weight > weighted[j].Weight })
+
+	shardLoad := make([]float64, shardCount)
+	var assigned []gazelle_label.Label
+	for _, wt := range weighted {
+		lightest := 0
+		for i := 1; i < shardCount; i++ {
+			if shardLoad[i] < shardLoad[lightest] {
+				lightest = i
+			}
+		}
+		shardLoad[lightest] += wt.Weight
+		if lightest == shardIndex {
+			assigned = append(assigned, wt.Target)
+		}
+	}
+	return assigned
+}
+
+// parsePhases parses the comma-separated -phases flag value into the set of phases to run,
+// returning an error if an unknown phase name is given.
+func parsePhases(raw string) (map[phase]bool, error) {
+	result := make(map[phase]bool, len(allPhases))
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		p := phase(part)
+		switch p {
+		case phaseBuild, phaseTest, phasePackage:
+			result[p] = true
+		default:
+			return nil, fmt.Errorf("unknown phase %q - allowed values: build, test, package", part)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("-phases must name at least one of: build, test, package")
+	}
+	return result, nil
 }
 
 func parseFlags() (*driverFlags, error) {
 	var flags driverFlags
 	flags.commonFlags = cli.RegisterCommonFlags()
-	flag.StringVar(&flags.manualTestMode, "manual-test-mode", "skip", "How to handle affected tests tagged manual. Possible values: run|skip")
+	flag.StringVar(&flags.manualTestMode, "manual-test-mode", "skip", "Deprecated, use -build-tag-filters=-manual instead. How to handle affected targets tagged manual; skip excludes them from both the test and build tag filters, so manual targets of every kind are skipped. Possible values: run|skip")
+	flag.StringVar(&flags.testTagFilters, "test-tag-filters", "", "Comma-separated list of +tag (require) and -tag (exclude) selectors applied to affected test targets, mirroring Bazel's own --test_tag_filters.")
+	flag.StringVar(&flags.buildTagFilters, "build-tag-filters", "", "Comma-separated list of +tag (require) and -tag (exclude) selectors applied to every affected target, mirroring Bazel's own --build_tag_filters.")
+	flag.StringVar(&flags.phases, "phases", "build,test,package", "Comma-separated list of phases to run. Possible values: build, test, package")
+	flag.StringVar(&flags.packageDir, "package-dir", "", "Directory to copy affected binaries' outputs into during the package phase. If empty, the package phase is skipped even if requested.")
+	flag.IntVar(&flags.flakyRetries, "flaky-retries", 0, "Number of times to retry a test target that fails before reporting it as failed rather than flaky.")
+	flag.StringVar(&flags.summaryJSON, "summary-json", "", "Path to write a machine-readable JSON summary of test attempts to. If empty, no summary is written.")
+	flag.StringVar(&flags.coverageDir, "coverage", "", "Directory to write a merged lcov coverage report to. If set, the test phase runs `bazel coverage` instead of `bazel test`.")
+	flag.StringVar(&flags.coverageScope, "coverage-scope", "affected", "Which packages to instrument when -coverage is set. Possible values: affected|all")
+	flag.BoolVar(&flags.coverageCobertura, "coverage-cobertura", false, "Additionally convert the merged lcov coverage report to Cobertura XML.")
+	flag.IntVar(&flags.shardIndex, "shard-index", 0, "This invocation's shard index, in the range [0, shard-count). Only meaningful when -shard-count > 1.")
+	flag.IntVar(&flags.shardCount, "shard-count", 1, "Number of disjoint shards to split affected test targets across. 1 (the default) disables sharding.")
+	flag.StringVar(&flags.timingsJSON, "timings-json", "", "Path to a JSON file mapping target label to historical test duration in seconds, used to weight-balance shard assignment.")
+	flag.StringVar(&flags.eventsJSON, "events-json", "", "Path to stream normalized newline-delimited JSON driver events to, or \"-\" for stdout. If empty, no events are emitted.")
 
-	flag.Parse()
+	// A plain flag.Parse() over os.Args[1:] would hand every remaining argument to
+	// cli.ValidateCommonFlags() as if it were the <before-revision> positional, with nowhere to
+	// put extra Bazel arguments. Instead, split off anything after an explicit "--" ourselves
+	// first, parse only the driver's own flags (and <before-revision>) through flag.CommandLine as
+	// usual, then bucket what follows "--" by phase. See splitDriverArgs/splitPassthroughArgs.
+	driverArgs, bazelArgs := splitDriverArgs(os.Args[1:])
+	if err := flag.CommandLine.Parse(driverArgs); err != nil {
+		return nil, err
+	}
+	flags.passthrough = splitPassthroughArgs(bazelArgs)
 
 	if flags.manualTestMode != "run" && flags.manualTestMode != "skip" {
 		return nil, fmt.Errorf("unexpected value for flag -manual-test-mode - allowed values: run|skip, saw: %s", flags.manualTestMode)
 	}
+	if flags.coverageScope != "affected" && flags.coverageScope != "all" {
+		return nil, fmt.Errorf("unexpected value for flag -coverage-scope - allowed values: affected|all, saw: %s", flags.coverageScope)
+	}
+	if flags.shardCount < 1 {
+		return nil, fmt.Errorf("-shard-count must be at least 1, saw: %d", flags.shardCount)
+	}
+	if flags.shardIndex < 0 || flags.shardIndex >= flags.shardCount {
+		return nil, fmt.Errorf("-shard-index must be in the range [0, %d), saw: %d", flags.shardCount, flags.shardIndex)
+	}
 
 	var err error
 	flags.revisionBefore, err = cli.ValidateCommonFlags()
@@ -153,10 +1117,46 @@ func resolveConfig(flags driverFlags) (*config, error) {
 		return nil, err
 	}
 
+	phases, err := parsePhases(flags.phases)
+	if err != nil {
+		return nil, err
+	}
+
+	testTagFilters, err := parseTagFilters(flags.testTagFilters)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -test-tag-filters: %w", err)
+	}
+	buildTagFilters, err := parseTagFilters(flags.buildTagFilters)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -build-tag-filters: %w", err)
+	}
+	testTagFilters, buildTagFilters = applyLegacyManualTestMode(flags.manualTestMode, testTagFilters, buildTagFilters)
+
 	return &config{
-		Context:        commonArgs.Context,
-		RevisionBefore: commonArgs.RevisionBefore,
-		TargetPattern:  commonArgs.TargetPattern,
-		ManualTestMode: flags.manualTestMode,
+		Context:           commonArgs.Context,
+		RevisionBefore:    commonArgs.RevisionBefore,
+		TargetPattern:     commonArgs.TargetPattern,
+		Phases:            phases,
+		PackageDir:        flags.packageDir,
+		TestTagFilters:    testTagFilters,
+		BuildTagFilters:   buildTagFilters,
+		FlakyRetries:      flags.flakyRetries,
+		SummaryJSON:       flags.summaryJSON,
+		CoverageDir:       flags.coverageDir,
+		CoverageScope:     flags.coverageScope,
+		CoverageCobertura: flags.coverageCobertura,
+		ShardIndex:        flags.shardIndex,
+		ShardCount:        flags.shardCount,
+		TimingsJSON:       flags.timingsJSON,
+		Passthrough:       flags.passthrough,
 	}, nil
 }
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	gazelle_label "github.com/bazelbuild/bazel-gazelle/label"
+)
+
+func TestParsePhases(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    map[phase]bool
+		wantErr bool
+	}{
+		{
+			name: "single phase",
+			raw:  "build",
+			want: map[phase]bool{phaseBuild: true},
+		},
+		{
+			name: "all phases, with surrounding whitespace and blank entries",
+			raw:  " build , test ,,package",
+			want: map[phase]bool{phaseBuild: true, phaseTest: true, phasePackage: true},
+		},
+		{
+			name:    "empty is an error",
+			raw:     "",
+			wantErr: true,
+		},
+		{
+			name:    "blank entries only is an error",
+			raw:     " , ,",
+			wantErr: true,
+		},
+		{
+			name:    "unknown phase is an error",
+			raw:     "build,deploy",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePhases(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePhases(%q) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePhases(%q) = %v, want %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetBucketsAll(t *testing.T) {
+	mustLabelPhases := func(s string) gazelle_label.Label {
+		l, err := gazelle_label.Parse(s)
+		if err != nil {
+			t.Fatalf("failed to parse label %q: %v", s, err)
+		}
+		return l
+	}
+
+	buckets := &targetBuckets{
+		Tests:    []gazelle_label.Label{mustLabelPhases("//foo:foo_test")},
+		Binaries: []gazelle_label.Label{mustLabelPhases("//foo:foo_binary")},
+		Other:    []gazelle_label.Label{mustLabelPhases("//foo:foo_lib")},
+	}
+
+	got := buckets.All()
+	want := []gazelle_label.Label{
+		mustLabelPhases("//foo:foo_test"),
+		mustLabelPhases("//foo:foo_binary"),
+		mustLabelPhases("//foo:foo_lib"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("targetBuckets.All() = %v, want %v (tests then binaries then other)", got, want)
+	}
+}
+
+func TestTargetBucketsAllEmpty(t *testing.T) {
+	buckets := &targetBuckets{}
+	if got := buckets.All(); len(got) != 0 {
+		t.Errorf("targetBuckets{}.All() = %v, want empty", got)
+	}
+}
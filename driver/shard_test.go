@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gazelle_label "github.com/bazelbuild/bazel-gazelle/label"
+)
+
+func mustLabel(t *testing.T, s string) gazelle_label.Label {
+	t.Helper()
+	l, err := gazelle_label.Parse(s)
+	if err != nil {
+		t.Fatalf("failed to parse label %q: %v", s, err)
+	}
+	return l
+}
+
+func TestStableHashIsDeterministic(t *testing.T) {
+	labels := []string{"//foo:foo_test", "//bar/baz:baz_test", "//a/b/c:c_test"}
+	for _, l := range labels {
+		first := stableHash(l)
+		for i := 0; i < 10; i++ {
+			if got := stableHash(l); got != first {
+				t.Errorf("stableHash(%q) = %d on call %d, want %d (first call)", l, got, i, first)
+			}
+		}
+	}
+}
+
+// TestShardTestTargetsExactlyOnce verifies the property the sharding feature exists for: every
+// affected test target is assigned to exactly one shard, whether or not historical timings are
+// supplied, across a range of shard counts.
+func TestShardTestTargetsExactlyOnce(t *testing.T) {
+	tests := []gazelle_label.Label{
+		mustLabel(t, "//foo:foo_test"),
+		mustLabel(t, "//bar/baz:baz_test"),
+		mustLabel(t, "//a/b/c:c_test"),
+		mustLabel(t, "//a/b/c:d_test"),
+		mustLabel(t, "//x:x_test"),
+		mustLabel(t, "//y:y_test"),
+		mustLabel(t, "//z:z_test"),
+	}
+
+	for _, shardCount := range []int{1, 2, 3, 7} {
+		seen := make(map[string]int, len(tests))
+		for shardIndex := 0; shardIndex < shardCount; shardIndex++ {
+			assigned, err := shardTestTargets(tests, shardIndex, shardCount, "")
+			if err != nil {
+				t.Fatalf("shardTestTargets(shardIndex=%d, shardCount=%d) returned error: %v", shardIndex, shardCount, err)
+			}
+			for _, target := range assigned {
+				seen[target.String()]++
+			}
+		}
+		if len(seen) != len(tests) {
+			t.Errorf("shardCount=%d: %d of %d targets were assigned to some shard", shardCount, len(seen), len(tests))
+		}
+		for target, count := range seen {
+			if count != 1 {
+				t.Errorf("shardCount=%d: target %s was assigned to %d shards, want exactly 1", shardCount, target, count)
+			}
+		}
+	}
+}
+
+// TestShardTestTargetsStableAcrossCalls verifies that two independent invocations (as would happen
+// across two separate CI worker processes) agree on the assignment without needing to coordinate.
+func TestShardTestTargetsStableAcrossCalls(t *testing.T) {
+	tests := []gazelle_label.Label{
+		mustLabel(t, "//foo:foo_test"),
+		mustLabel(t, "//bar/baz:baz_test"),
+		mustLabel(t, "//a/b/c:c_test"),
+	}
+
+	first, err := shardTestTargets(tests, 0, 2, "")
+	if err != nil {
+		t.Fatalf("shardTestTargets returned error: %v", err)
+	}
+	second, err := shardTestTargets(tests, 0, 2, "")
+	if err != nil {
+		t.Fatalf("shardTestTargets returned error: %v", err)
+	}
+	if len(first) != len(second) {
+		t.Fatalf("got differing assignments across calls: %v vs %v", first, second)
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("got differing assignments across calls at index %d: %v vs %v", i, first[i], second[i])
+		}
+	}
+}
+
+func TestShardTestTargetsWithTimings(t *testing.T) {
+	tests := []gazelle_label.Label{
+		mustLabel(t, "//foo:foo_test"),
+		mustLabel(t, "//bar:bar_test"),
+		mustLabel(t, "//baz:baz_test"),
+		mustLabel(t, "//qux:qux_test"),
+	}
+	timings := map[string]float64{
+		"//foo:foo_test": 100,
+		"//bar:bar_test": 1,
+		"//baz:baz_test": 1,
+		"//qux:qux_test": 1,
+	}
+
+	timingsPath := filepath.Join(t.TempDir(), "timings.json")
+	contents, err := json.Marshal(timings)
+	if err != nil {
+		t.Fatalf("failed to marshal timings: %v", err)
+	}
+	if err := os.WriteFile(timingsPath, contents, 0o644); err != nil {
+		t.Fatalf("failed to write timings file: %v", err)
+	}
+
+	shardOfHeaviest := -1
+	seen := make(map[string]int, len(tests))
+	for shardIndex := 0; shardIndex < 2; shardIndex++ {
+		assigned, err := shardTestTargets(tests, shardIndex, 2, timingsPath)
+		if err != nil {
+			t.Fatalf("shardTestTargets(shardIndex=%d) returned error: %v", shardIndex, err)
+		}
+		for _, target := range assigned {
+			seen[target.String()]++
+			if target.String() == "//foo:foo_test" {
+				shardOfHeaviest = shardIndex
+			}
+		}
+	}
+	for target, count := range seen {
+		if count != 1 {
+			t.Errorf("target %s was assigned to %d shards, want exactly 1", target, count)
+		}
+	}
+	// The heavy target should have a shard to itself: the three weight-1 targets should all have
+	// landed on the other shard, since greedy LPT always picks the currently-lightest shard.
+	other := 1 - shardOfHeaviest
+	assigned, err := shardTestTargets(tests, other, 2, timingsPath)
+	if err != nil {
+		t.Fatalf("shardTestTargets(shardIndex=%d) returned error: %v", other, err)
+	}
+	if len(assigned) != 3 {
+		t.Errorf("expected the 3 light targets to be balanced onto the shard without the heavy target, got %d targets: %v", len(assigned), assigned)
+	}
+}
+
+func TestLPTAssignExactlyOnce(t *testing.T) {
+	targets := []gazelle_label.Label{
+		mustLabel(t, "//a:a_test"),
+		mustLabel(t, "//b:b_test"),
+		mustLabel(t, "//c:c_test"),
+		mustLabel(t, "//d:d_test"),
+		mustLabel(t, "//e:e_test"),
+	}
+	timings := map[string]float64{
+		"//a:a_test": 5,
+		"//b:b_test": 3,
+		"//c:c_test": 3,
+		"//d:d_test": 2,
+		// "//e:e_test" intentionally has no recorded timing, so it should be treated as weight 1.
+	}
+
+	const shardCount = 3
+	seen := make(map[string]int, len(targets))
+	for shardIndex := 0; shardIndex < shardCount; shardIndex++ {
+		assigned := lptAssign(targets, timings, shardIndex, shardCount)
+		for _, target := range assigned {
+			seen[target.String()]++
+		}
+	}
+	if len(seen) != len(targets) {
+		t.Errorf("got %d of %d targets assigned to some shard", len(seen), len(targets))
+	}
+	for target, count := range seen {
+		if count != 1 {
+			t.Errorf("target %s was assigned to %d shards, want exactly 1", target, count)
+		}
+	}
+}
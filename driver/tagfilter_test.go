@@ -0,0 +1,185 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+)
+
+func TestParseTagFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    tagFilter
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			raw:  "",
+			want: tagFilter{},
+		},
+		{
+			name: "require only",
+			raw:  "+foo,+bar",
+			want: tagFilter{Require: []string{"foo", "bar"}},
+		},
+		{
+			name: "exclude only",
+			raw:  "-foo,-bar",
+			want: tagFilter{Exclude: []string{"foo", "bar"}},
+		},
+		{
+			name: "mixed require and exclude, with surrounding whitespace and blank entries",
+			raw:  " +foo , -bar ,,+baz",
+			want: tagFilter{Require: []string{"foo", "baz"}, Exclude: []string{"bar"}},
+		},
+		{
+			name:    "entry missing + or - prefix is an error",
+			raw:     "foo",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTagFilters(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTagFilters(%q) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTagFilters(%q) = %+v, want %+v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string { return &s }
+
+// configuredTargetWithTags builds a minimal *analysis.ConfiguredTarget carrying the given "tags"
+// attribute, mirroring the shape targetTags/matchTagFilters read back out of real cquery output.
+func configuredTargetWithTags(tags []string) *analysis.ConfiguredTarget {
+	return &analysis.ConfiguredTarget{
+		Target: &analysis.Target{
+			Rule: &analysis.Rule{
+				Attribute: []*analysis.Attribute{
+					{
+						Name:            strPtr("tags"),
+						StringListValue: tags,
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestMatchTagFilters(t *testing.T) {
+	tests := []struct {
+		name   string
+		tags   []string
+		filter tagFilter
+		want   bool
+	}{
+		{
+			name:   "no filter matches anything",
+			tags:   []string{"foo"},
+			filter: tagFilter{},
+			want:   true,
+		},
+		{
+			name:   "require satisfied",
+			tags:   []string{"foo", "bar"},
+			filter: tagFilter{Require: []string{"foo"}},
+			want:   true,
+		},
+		{
+			name:   "require not satisfied",
+			tags:   []string{"bar"},
+			filter: tagFilter{Require: []string{"foo"}},
+			want:   false,
+		},
+		{
+			name:   "exclude matched",
+			tags:   []string{"manual"},
+			filter: tagFilter{Exclude: []string{"manual"}},
+			want:   false,
+		},
+		{
+			name:   "exclude not matched",
+			tags:   []string{"foo"},
+			filter: tagFilter{Exclude: []string{"manual"}},
+			want:   true,
+		},
+		{
+			name:   "require and exclude both satisfied",
+			tags:   []string{"foo"},
+			filter: tagFilter{Require: []string{"foo"}, Exclude: []string{"manual"}},
+			want:   true,
+		},
+		{
+			name:   "empty tags attribute",
+			tags:   nil,
+			filter: tagFilter{Require: []string{"foo"}},
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := configuredTargetWithTags(tt.tags)
+			if got := matchTagFilters(target, tt.filter); got != tt.want {
+				t.Errorf("matchTagFilters(tags=%v, filter=%+v) = %v, want %v", tt.tags, tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyLegacyManualTestMode(t *testing.T) {
+	tests := []struct {
+		name            string
+		manualTestMode  string
+		testTagFilters  tagFilter
+		buildTagFilters tagFilter
+		wantTest        tagFilter
+		wantBuild       tagFilter
+	}{
+		{
+			name:           "run is a no-op",
+			manualTestMode: "run",
+			testTagFilters: tagFilter{Exclude: []string{"slow"}},
+			wantTest:       tagFilter{Exclude: []string{"slow"}},
+			wantBuild:      tagFilter{},
+		},
+		{
+			name:            "skip excludes manual from both test and build filters",
+			manualTestMode:  "skip",
+			testTagFilters:  tagFilter{},
+			buildTagFilters: tagFilter{},
+			wantTest:        tagFilter{Exclude: []string{"manual"}},
+			wantBuild:       tagFilter{Exclude: []string{"manual"}},
+		},
+		{
+			name:            "skip doesn't duplicate an already-present manual exclude",
+			manualTestMode:  "skip",
+			testTagFilters:  tagFilter{Exclude: []string{"manual"}},
+			buildTagFilters: tagFilter{Exclude: []string{"flaky", "manual"}},
+			wantTest:        tagFilter{Exclude: []string{"manual"}},
+			wantBuild:       tagFilter{Exclude: []string{"flaky", "manual"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotTest, gotBuild := applyLegacyManualTestMode(tt.manualTestMode, tt.testTagFilters, tt.buildTagFilters)
+			if !reflect.DeepEqual(gotTest, tt.wantTest) {
+				t.Errorf("applyLegacyManualTestMode(%q) testTagFilters = %+v, want %+v", tt.manualTestMode, gotTest, tt.wantTest)
+			}
+			if !reflect.DeepEqual(gotBuild, tt.wantBuild) {
+				t.Errorf("applyLegacyManualTestMode(%q) buildTagFilters = %+v, want %+v", tt.manualTestMode, gotBuild, tt.wantBuild)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestClassifyTestStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts []attemptInfo
+		want     testStatus
+	}{
+		{
+			name:     "no attempts at all",
+			attempts: nil,
+			want:     testStatusFail,
+		},
+		{
+			name:     "passed on the first attempt",
+			attempts: []attemptInfo{{Attempt: 1, Passed: true}},
+			want:     testStatusPass,
+		},
+		{
+			name:     "failed then passed on retry is flaky",
+			attempts: []attemptInfo{{Attempt: 1, Passed: false}, {Attempt: 2, Passed: true}},
+			want:     testStatusFlaky,
+		},
+		{
+			name: "failed on every attempt",
+			attempts: []attemptInfo{
+				{Attempt: 1, Passed: false},
+				{Attempt: 2, Passed: false},
+				{Attempt: 3, Passed: false},
+			},
+			want: testStatusFail,
+		},
+		{
+			name: "passed only on the last of several retries is still flaky",
+			attempts: []attemptInfo{
+				{Attempt: 1, Passed: false},
+				{Attempt: 2, Passed: false},
+				{Attempt: 3, Passed: true},
+			},
+			want: testStatusFlaky,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyTestStatus(tt.attempts); got != tt.want {
+				t.Errorf("classifyTestStatus(%+v) = %q, want %q", tt.attempts, got, tt.want)
+			}
+		})
+	}
+}